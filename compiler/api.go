@@ -0,0 +1,150 @@
+package compiler
+
+import (
+	"code.google.com/p/go.tools/go/types"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// WriteAPI writes a stable, line-oriented manifest of pkg's exported API to
+// w, one line per exported object in the form cmd/api uses, e.g.:
+//
+//	pkg net/http, func Get(string) (*Response, error)
+//	pkg net/http, type Client struct
+//	pkg net/http, method (*Client) Do(*Request) (*Response, error)
+//
+// Lines are sorted so that diffing manifests across builds catches
+// accidental ABI drift in the JS output, including natives overrides that
+// silently change an exported signature. It requires pkg's types to
+// already be loaded into t (via UnmarshalArchive or LoadTypes).
+func (t *Compiler) WriteAPI(pkg *Archive, w io.Writer) error {
+	path := string(pkg.ImportPath)
+	typesPkg, ok := t.typesPackages[path]
+	if !ok {
+		return fmt.Errorf("compiler: types for package %q are not loaded", path)
+	}
+
+	qualifier := func(other *types.Package) string {
+		if other == typesPkg {
+			return ""
+		}
+		return other.Path()
+	}
+
+	var lines []string
+	scope := typesPkg.Scope()
+	for _, name := range scope.Names() {
+		obj := scope.Lookup(name)
+		if !obj.Exported() {
+			continue
+		}
+		switch o := obj.(type) {
+		case *types.TypeName:
+			lines = append(lines, apiTypeLines(path, o, qualifier)...)
+		case *types.Func:
+			lines = append(lines, fmt.Sprintf("pkg %s, func %s%s", path, o.Name(), apiSignature(o.Type().(*types.Signature), qualifier)))
+		case *types.Var:
+			lines = append(lines, fmt.Sprintf("pkg %s, var %s %s", path, o.Name(), types.TypeString(o.Type(), qualifier)))
+		case *types.Const:
+			lines = append(lines, fmt.Sprintf("pkg %s, const %s %s", path, o.Name(), types.TypeString(o.Type(), qualifier)))
+		}
+	}
+
+	sort.Strings(lines)
+	for _, line := range lines {
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// apiTypeLines renders a named type declaration plus one line per exported
+// struct field and per exported method in its method set. Each method is
+// listed once, under the receiver it was actually declared with: the
+// pointer method set is a superset of the value method set (a value
+// receiver method shows up under both), so value-receiver methods are
+// listed from the value set and only the remaining, pointer-only methods
+// are taken from the pointer set.
+func apiTypeLines(path string, name *types.TypeName, qualifier types.Qualifier) []string {
+	lines := []string{fmt.Sprintf("pkg %s, type %s %s", path, name.Name(), apiUnderlyingKind(name.Type().Underlying()))}
+
+	if st, ok := name.Type().Underlying().(*types.Struct); ok {
+		for i := 0; i < st.NumFields(); i++ {
+			f := st.Field(i)
+			if !f.Exported() {
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("pkg %s, type %s struct, %s %s", path, name.Name(), f.Name(), types.TypeString(f.Type(), qualifier)))
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, recv := range []types.Type{name.Type(), types.NewPointer(name.Type())} {
+		mset := types.NewMethodSet(recv)
+		for i := 0; i < mset.Len(); i++ {
+			fn, ok := mset.At(i).Obj().(*types.Func)
+			if !ok || !fn.Exported() || seen[fn.Name()] {
+				continue
+			}
+			seen[fn.Name()] = true
+			lines = append(lines, fmt.Sprintf("pkg %s, method (%s) %s%s", path, apiReceiverString(recv, qualifier), fn.Name(), apiSignature(fn.Type().(*types.Signature), qualifier)))
+		}
+	}
+
+	return lines
+}
+
+// apiUnderlyingKind names the kind of declaration a named type's
+// underlying type renders as in a cmd/api-style manifest.
+func apiUnderlyingKind(u types.Type) string {
+	switch u.(type) {
+	case *types.Struct:
+		return "struct"
+	case *types.Interface:
+		return "interface"
+	default:
+		return types.TypeString(u, nil)
+	}
+}
+
+func apiReceiverString(recv types.Type, qualifier types.Qualifier) string {
+	if ptr, ok := recv.(*types.Pointer); ok {
+		return "*" + types.TypeString(ptr.Elem(), qualifier)
+	}
+	return types.TypeString(recv, qualifier)
+}
+
+// apiSignature renders a function signature's parameter and result lists,
+// dropping the receiver (callers that need it render it separately) and
+// the package-qualifier noise for the package under inspection.
+func apiSignature(sig *types.Signature, qualifier types.Qualifier) string {
+	params := apiTupleString(sig.Params(), sig.Variadic(), qualifier)
+	results := ""
+	switch sig.Results().Len() {
+	case 0:
+		// no results
+	case 1:
+		results = " " + types.TypeString(sig.Results().At(0).Type(), qualifier)
+	default:
+		results = " " + apiTupleString(sig.Results(), false, qualifier)
+	}
+	return params + results
+}
+
+func apiTupleString(tuple *types.Tuple, variadic bool, qualifier types.Qualifier) string {
+	s := "("
+	for i := 0; i < tuple.Len(); i++ {
+		if i > 0 {
+			s += ", "
+		}
+		typ := tuple.At(i).Type()
+		if variadic && i == tuple.Len()-1 {
+			s += "..." + types.TypeString(typ.(*types.Slice).Elem(), qualifier)
+			continue
+		}
+		s += types.TypeString(typ, qualifier)
+	}
+	return s + ")"
+}
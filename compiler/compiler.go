@@ -2,7 +2,6 @@ package compiler
 
 import (
 	"bytes"
-	"code.google.com/p/go.tools/go/gcimporter"
 	"code.google.com/p/go.tools/go/types"
 	"encoding/asn1"
 	"encoding/binary"
@@ -14,6 +13,7 @@ import (
 	"go/scanner"
 	"go/token"
 	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sort"
@@ -75,7 +75,15 @@ func Import(path string, mode build.ImportMode, archSuffix string) (*build.Packa
 	return pkg, err
 }
 
+// Parse calls (*Compiler).Parse on a fresh Compiler from New, so it ignores
+// the settings of any Compiler the caller holds. Either way the natives
+// overlay is resolved via GOPATH/GOROOT: (*Compiler).Import always hands
+// nativesPrefix paths to the package-level Import.
 func Parse(pkg *build.Package, fileSet *token.FileSet) ([]*ast.File, error) {
+	return New().Parse(pkg, fileSet)
+}
+
+func (t *Compiler) Parse(pkg *build.Package, fileSet *token.FileSet) ([]*ast.File, error) {
 	var files []*ast.File
 	replacedDeclNames := make(map[string]bool)
 	funcName := func(d *ast.FuncDecl) string {
@@ -93,7 +101,7 @@ func Parse(pkg *build.Package, fileSet *token.FileSet) ([]*ast.File, error) {
 	if isTestPkg {
 		importPath = importPath[:len(importPath)-5]
 	}
-	if nativesPkg, err := Import("github.com/gopherjs/gopherjs/compiler/natives/"+importPath, 0, "js"); err == nil {
+	if nativesPkg, err := t.Import(nativesPrefix+importPath, 0, "js"); err == nil {
 		names := nativesPkg.GoFiles
 		if isTestPkg {
 			names = nativesPkg.XTestGoFiles
@@ -150,22 +158,51 @@ func Parse(pkg *build.Package, fileSet *token.FileSet) ([]*ast.File, error) {
 
 type Compiler struct {
 	typesPackages map[string]*types.Package
+
+	// ModuleMode is not read by Import: Import auto-detects module mode by
+	// looking for a go.mod above the working directory on every call,
+	// whatever this field holds, and then resolves packages through the
+	// module graph rooted at that go.mod instead of GOPATH. Call
+	// DisableModuleMode (which also sets this field to false) to force
+	// GOPATH resolution even when a go.mod is found.
+	ModuleMode bool
+
+	// moduleModeDisabled, once set via DisableModuleMode, forces Import to
+	// use GOPATH resolution regardless of ModuleMode or any go.mod found
+	// above the working directory.
+	moduleModeDisabled bool
+
+	// SourceFS, if non-nil, is used by ParseFS and ImportFS in place of the
+	// OS filesystem whenever they are passed a nil fsys, so the compiler
+	// can run against in-memory source trees (editor plugins, WASM-hosted
+	// playgrounds, bazel-style sandboxes). When left nil, the package-level
+	// SourceFS (an adapter over the OS) is used instead.
+	SourceFS fs.FS
+
+	// Importer decodes an Archive's GcData for any GcDataFormat other than
+	// GcDataFormatGc and GcDataFormatNone, which are always handled
+	// internally. Leave nil unless
+	// the compiler needs to read archives from a non-gc backend.
+	Importer TypesImporter
 }
 
 func New() *Compiler {
-	return &Compiler{map[string]*types.Package{"unsafe": types.Unsafe}}
+	return &Compiler{typesPackages: map[string]*types.Package{"unsafe": types.Unsafe}}
 }
 
-func (t *Compiler) NewEmptyTypesPackage(path string) {
-	t.typesPackages[path] = types.NewPackage(path, path)
-}
+func (t *Compiler) WriteProgramCode(pkgs []*Archive, mainPkgPath string, minify bool, archSuffix string, w *SourceMapFilter, m *SourceMapBuilder) {
+	if m != nil {
+		w.MappingCallback = func(generatedLine, generatedColumn int, fileSet *token.FileSet, originalPos token.Pos) {
+			m.AddMapping(generatedLine, generatedColumn, fileSet, originalPos, "")
+		}
+	}
 
-func (t *Compiler) WriteProgramCode(pkgs []*Archive, mainPkgPath string, minify bool, w *SourceMapFilter) {
 	declsByObject := make(map[string][]*Decl)
 	var pendingDecls []*Decl
 	for _, pkg := range pkgs {
-		for i := range pkg.Declarations {
-			d := &pkg.Declarations[i]
+		decls := pkg.Decls(archSuffix)
+		for i := range decls {
+			d := &decls[i]
 			if len(d.DceFilters) == 0 {
 				pendingDecls = append(pendingDecls, d)
 				continue
@@ -207,7 +244,7 @@ func (t *Compiler) WriteProgramCode(pkgs []*Archive, mainPkgPath string, minify
 
 	// write packages
 	for _, pkg := range pkgs {
-		t.WritePkgCode(pkg, minify, w)
+		t.WritePkgCode(pkg, archSuffix, minify, w)
 	}
 
 	// write interfaces
@@ -270,21 +307,27 @@ func (t *Compiler) WriteProgramCode(pkgs []*Archive, mainPkgPath string, minify
 	}
 
 	w.Write([]byte("$packages[\"" + mainPkgPath + "\"].main(function() {});\n\n})();\n"))
+
+	if m != nil {
+		url := m.File + ".map"
+		w.Write([]byte("//# sourceMappingURL=" + url + "\n"))
+	}
 }
 
-func (t *Compiler) WritePkgCode(pkg *Archive, minify bool, w *SourceMapFilter) {
+func (t *Compiler) WritePkgCode(pkg *Archive, archSuffix string, minify bool, w *SourceMapFilter) {
 	if w.MappingCallback != nil && pkg.FileSet != nil {
 		w.fileSet = token.NewFileSet()
 		if err := w.fileSet.Read(json.NewDecoder(bytes.NewReader(pkg.FileSet)).Decode); err != nil {
 			panic(err)
 		}
 	}
+	decls := pkg.Decls(archSuffix)
 	w.Write(removeWhitespace([]byte(fmt.Sprintf("$packages[\"%s\"] = (function() {\n", pkg.ImportPath)), minify))
 	vars := []string{"$pkg = {}"}
 	for _, imp := range pkg.Imports {
 		vars = append(vars, fmt.Sprintf("%s = $packages[\"%s\"]", imp.VarName, imp.Path))
 	}
-	for _, d := range pkg.Declarations {
+	for _, d := range decls {
 		if len(d.DceFilters) == 0 && d.Var != "" {
 			vars = append(vars, d.Var)
 		}
@@ -292,13 +335,13 @@ func (t *Compiler) WritePkgCode(pkg *Archive, minify bool, w *SourceMapFilter) {
 	if len(vars) != 0 {
 		w.Write(removeWhitespace([]byte(fmt.Sprintf("\tvar %s;\n", strings.Join(vars, ", "))), minify))
 	}
-	for _, d := range pkg.Declarations {
+	for _, d := range decls {
 		if len(d.DceFilters) == 0 {
 			w.Write(d.BodyCode)
 		}
 	}
 	w.Write(removeWhitespace([]byte("\t$pkg.init = function() {\n"), minify))
-	for _, d := range pkg.Declarations {
+	for _, d := range decls {
 		if len(d.DceFilters) == 0 {
 			w.Write(d.InitCode)
 		}
@@ -307,36 +350,178 @@ func (t *Compiler) WritePkgCode(pkg *Archive, minify bool, w *SourceMapFilter) {
 	w.Write([]byte("\n")) // keep this \n even when minified
 }
 
+// archiveMagic prefixes the on-disk form of an Archive written by a
+// version-2-or-later MarshalArchive, distinguishing it from the flat,
+// single-variant archives older versions of GopherJS produced.
+var archiveMagic = [4]byte{'G', 'J', 'S', 'A'}
+
+// archiveVersion is bumped whenever the on-disk Archive layout changes in
+// a way old readers can't cope with. Version 2 introduced per-arch
+// declaration variants.
+const archiveVersion = 2
+
+// archVariant is one ArchVariants entry in asn1-encodable form (asn1 has
+// no map support).
+type archVariant struct {
+	Arch  string
+	Decls []Decl
+}
+
+// archiveDisk is the asn1-encoded payload written after the archive
+// header. It differs from Archive in that ArchVariants is encoded as a
+// sorted slice of entries, GcDataFormat as a plain string, and Version is
+// not part of it: the version is carried in the header.
+type archiveDisk struct {
+	ImportPath   PkgPath
+	GcData       []byte
+	GcDataFormat string
+	Dependencies []PkgPath
+	Imports      []PkgImport
+	Variants     []archVariant
+	Tests        []string
+	FileSet      []byte
+}
+
+// legacyArchive is the pre-version-2 on-disk layout: a single, flat
+// declaration list with no header in front of it. UnmarshalArchive falls
+// back to this when data doesn't start with archiveMagic, treating the
+// flat list as the "" (default) variant.
+type legacyArchive struct {
+	ImportPath   PkgPath
+	GcData       []byte
+	Dependencies []PkgPath
+	Imports      []PkgImport
+	Declarations []Decl
+	Tests        []string
+	FileSet      []byte
+}
+
 func (t *Compiler) UnmarshalArchive(filename, id string, data []byte) (*Archive, error) {
-	var a Archive
-	_, err := asn1.Unmarshal(data, &a)
-	if err != nil {
-		return nil, err
+	var disk archiveDisk
+	version := 1
+	if len(data) >= len(archiveMagic)+4 && [4]byte{data[0], data[1], data[2], data[3]} == archiveMagic {
+		version = int(binary.BigEndian.Uint32(data[len(archiveMagic):]))
+		if _, err := asn1.Unmarshal(data[len(archiveMagic)+4:], &disk); err != nil {
+			return nil, err
+		}
+	} else {
+		var legacy legacyArchive
+		if _, err := asn1.Unmarshal(data, &legacy); err != nil {
+			return nil, err
+		}
+		disk = archiveDisk{
+			ImportPath:   legacy.ImportPath,
+			GcData:       legacy.GcData,
+			GcDataFormat: string(GcDataFormatGc),
+			Dependencies: legacy.Dependencies,
+			Imports:      legacy.Imports,
+			Variants:     []archVariant{{Arch: "", Decls: legacy.Declarations}},
+			Tests:        legacy.Tests,
+			FileSet:      legacy.FileSet,
+		}
+	}
+	if disk.GcDataFormat == "" {
+		disk.GcDataFormat = string(GcDataFormatGc)
 	}
 
-	pkg, err := gcimporter.ImportData(t.typesPackages, filename, id, bytes.NewReader(a.GcData))
-	if err != nil {
+	if _, err := t.LoadTypes(filename, id, disk.GcData, GcDataFormat(disk.GcDataFormat)); err != nil {
 		return nil, err
 	}
-	t.typesPackages[pkg.Path()] = pkg
 
-	return &a, nil
+	a := &Archive{
+		Version:      version,
+		ImportPath:   disk.ImportPath,
+		GcData:       disk.GcData,
+		GcDataFormat: GcDataFormat(disk.GcDataFormat),
+		Dependencies: disk.Dependencies,
+		Imports:      disk.Imports,
+		ArchVariants: make(map[string][]Decl, len(disk.Variants)),
+		Tests:        disk.Tests,
+		FileSet:      disk.FileSet,
+	}
+	for _, v := range disk.Variants {
+		a.ArchVariants[v.Arch] = v.Decls
+	}
+	return a, nil
 }
 
 func (t *Compiler) MarshalArchive(a *Archive) ([]byte, error) {
-	return asn1.Marshal(*a)
+	variants := make([]string, 0, len(a.ArchVariants))
+	for arch := range a.ArchVariants {
+		variants = append(variants, arch)
+	}
+	sort.Strings(variants)
+
+	format := a.GcDataFormat
+	if format == "" {
+		format = GcDataFormatGc
+	}
+	disk := archiveDisk{
+		ImportPath:   a.ImportPath,
+		GcData:       a.GcData,
+		GcDataFormat: string(format),
+		Dependencies: a.Dependencies,
+		Imports:      a.Imports,
+		Tests:        a.Tests,
+		FileSet:      a.FileSet,
+	}
+	for _, arch := range variants {
+		disk.Variants = append(disk.Variants, archVariant{Arch: arch, Decls: a.ArchVariants[arch]})
+	}
+
+	body, err := asn1.Marshal(disk)
+	if err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, len(archiveMagic)+4)
+	copy(header, archiveMagic[:])
+	binary.BigEndian.PutUint32(header[len(archiveMagic):], archiveVersion)
+	return append(header, body...), nil
 }
 
 type Archive struct {
-	ImportPath   PkgPath
-	GcData       []byte
+	// Version is the on-disk archive format version this Archive was read
+	// as, or archiveVersion for one built fresh. Readers that only
+	// understand the default variant can still make sense of a version-1
+	// (pre-multi-arch) archive.
+	Version    int
+	ImportPath PkgPath
+	GcData     []byte
+	// GcDataFormat tags which decoder LoadTypes must use to turn GcData
+	// back into a *types.Package. Defaults to GcDataFormatGc when unset,
+	// matching every archive written before this field existed.
+	GcDataFormat GcDataFormat
 	Dependencies []PkgPath
 	Imports      []PkgImport
-	Declarations []Decl
+	// ArchVariants holds the package's declarations keyed by arch suffix
+	// (e.g. "amd64", "wasm"), so a single .a.js can carry declaration sets
+	// for every arch a distributor wants to ship, rather than one archive
+	// per arch directory. "" is the default variant, used by archives that
+	// don't vary by arch and as the fallback for older callers.
+	ArchVariants map[string][]Decl
 	Tests        []string
 	FileSet      []byte
 }
 
+// Decls returns the declaration set for archSuffix, falling back to the
+// default ("") variant when no arch-specific one was recorded.
+// Decls returns the declaration set for archSuffix, falling back to the
+// default ("") variant when no arch-specific one was recorded. It panics if
+// neither is present, rather than returning a silent nil that WritePkgCode
+// or WriteProgramCode would go on to render as a package with no
+// declarations at all - a failure that would otherwise only surface much
+// later, as an undefined-property TypeError in the generated JS.
+func (a *Archive) Decls(archSuffix string) []Decl {
+	if decls, ok := a.ArchVariants[archSuffix]; ok {
+		return decls
+	}
+	if decls, ok := a.ArchVariants[""]; ok {
+		return decls
+	}
+	panic(fmt.Errorf("compiler: archive for %q has no %q or default declaration variant", a.ImportPath, archSuffix))
+}
+
 type PkgPath []byte // make asn1 happy
 
 func (a *Archive) AddDependency(path string) {
@@ -0,0 +1,207 @@
+package compiler
+
+import (
+	"go/ast"
+	"go/build"
+	"go/parser"
+	"go/scanner"
+	"go/token"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SourceFS is the default fs.FS used by ParseFS and ImportFS when they are
+// passed a nil fsys and the Compiler doesn't set one: a thin adapter over the host
+// filesystem rooted at "/", matching what os.Open and go/build already do.
+var SourceFS fs.FS = osFS{}
+
+type osFS struct{}
+
+// Open implements fs.FS. name arrives relative and slash-separated (per
+// io/fs's rules, stripped of its leading "/" by toFSPath); re-root it
+// before handing it to os.Open so that an absolute source path resolves
+// against "/" rather than the process's current directory.
+func (osFS) Open(name string) (fs.File, error) {
+	return os.Open(filepath.FromSlash("/" + name))
+}
+
+// ImportFS resolves path with go/build, as Import does, but reads source
+// through fsys instead of the OS, so that callers who keep source in memory
+// (editor plugins, WASM-hosted playgrounds, bazel-style sandboxes) don't
+// need a real GOPATH on disk. srcDir is the directory relative import paths
+// ("./x") are resolved against; other paths are looked up under the
+// GOROOT/src and GOPATH/src of build.Default, inside fsys. Unlike Import,
+// ImportFS applies none of Import's per-package adjustments: it doesn't
+// reject "C", special-case runtime and syscall, trim hash/crc32's file list
+// or rewrite PkgObj.
+func (t *Compiler) ImportFS(fsys fs.FS, srcDir, path string, mode build.ImportMode, archSuffix string) (*build.Package, error) {
+	if fsys == nil {
+		fsys = t.sourceFS()
+	}
+	buildContext := &build.Context{
+		GOROOT:    build.Default.GOROOT,
+		GOPATH:    build.Default.GOPATH,
+		GOOS:      build.Default.GOOS,
+		GOARCH:    archSuffix,
+		Compiler:  "gc",
+		BuildTags: []string{"netgo"},
+	}
+	wireFS(buildContext, fsys)
+	return buildContext.Import(path, srcDir, mode)
+}
+
+// wireFS points a build.Context's filesystem hooks at fsys, so that
+// buildContext.Import reads source from fsys instead of the OS.
+func wireFS(buildContext *build.Context, fsys fs.FS) {
+	buildContext.OpenFile = func(name string) (io.ReadCloser, error) {
+		return fsys.Open(toFSPath(name))
+	}
+	buildContext.ReadDir = func(dir string) ([]os.FileInfo, error) {
+		entries, err := fs.ReadDir(fsys, toFSPath(dir))
+		if err != nil {
+			return nil, err
+		}
+		infos := make([]os.FileInfo, len(entries))
+		for i, e := range entries {
+			info, err := e.Info()
+			if err != nil {
+				return nil, err
+			}
+			infos[i] = info
+		}
+		return infos, nil
+	}
+	buildContext.IsDir = func(name string) bool {
+		info, err := fs.Stat(fsys, toFSPath(name))
+		return err == nil && info.IsDir()
+	}
+	buildContext.HasSubdir = func(root, dir string) (rel string, ok bool) {
+		root = filepath.ToSlash(root)
+		dir = filepath.ToSlash(dir)
+		if dir == root {
+			return "", true
+		}
+		if len(dir) > len(root) && dir[len(root)] == '/' && dir[:len(root)] == root {
+			return dir[len(root)+1:], true
+		}
+		return "", false
+	}
+	buildContext.JoinPath = func(elem ...string) string {
+		return path.Join(elem...)
+	}
+}
+
+// sourceFS returns t.SourceFS, falling back to the OS-backed default when
+// the Compiler doesn't set one.
+func (t *Compiler) sourceFS() fs.FS {
+	if t.SourceFS != nil {
+		return t.SourceFS
+	}
+	return SourceFS
+}
+
+// toFSPath turns an absolute or OS-separated path into the slash-separated,
+// non-rooted form io/fs.FS requires.
+func toFSPath(name string) string {
+	name = filepath.ToSlash(name)
+	for len(name) > 0 && name[0] == '/' {
+		name = name[1:]
+	}
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// ParseFS behaves like Parse, except that pkg's Go files (and, if present,
+// its natives overlay) are read from fsys rather than the OS, and a natives
+// file that fails to parse is returned as an error where Parse panics.
+// Embedders that ship the natives overlay via an embed.FS can pass it here
+// so that github.com/gopherjs/gopherjs/compiler/natives/... is loaded from
+// the same in-memory source as the rest of the program.
+func (t *Compiler) ParseFS(pkg *build.Package, fileSet *token.FileSet, fsys fs.FS) ([]*ast.File, error) {
+	if fsys == nil {
+		fsys = t.sourceFS()
+	}
+
+	var files []*ast.File
+	replacedDeclNames := make(map[string]bool)
+	funcName := func(d *ast.FuncDecl) string {
+		if d.Recv == nil {
+			return d.Name.Name
+		}
+		recv := d.Recv.List[0].Type
+		if star, ok := recv.(*ast.StarExpr); ok {
+			recv = star.X
+		}
+		return recv.(*ast.Ident).Name + "." + d.Name.Name
+	}
+	isTestPkg := strings.HasSuffix(pkg.ImportPath, "_test")
+	importPath := pkg.ImportPath
+	if isTestPkg {
+		importPath = importPath[:len(importPath)-5]
+	}
+	if nativesPkg, err := t.ImportFS(fsys, "", nativesPrefix+importPath, 0, "js"); err == nil {
+		names := nativesPkg.GoFiles
+		if isTestPkg {
+			names = nativesPkg.XTestGoFiles
+		}
+		for _, name := range names {
+			p := path.Join(filepath.ToSlash(nativesPkg.Dir), name)
+			r, err := fsys.Open(toFSPath(p))
+			if err != nil {
+				return nil, err
+			}
+			file, err := parser.ParseFile(fileSet, p, r, 0)
+			r.Close()
+			if err != nil {
+				return nil, err
+			}
+			for _, decl := range file.Decls {
+				if d, ok := decl.(*ast.FuncDecl); ok {
+					replacedDeclNames[funcName(d)] = true
+				}
+			}
+			files = append(files, file)
+		}
+	}
+	delete(replacedDeclNames, "init")
+
+	var errList ErrorList
+	for _, name := range pkg.GoFiles {
+		p := name
+		if !path.IsAbs(p) {
+			p = path.Join(pkg.Dir, name)
+		}
+		r, err := fsys.Open(toFSPath(p))
+		if err != nil {
+			return nil, err
+		}
+		file, err := parser.ParseFile(fileSet, p, r, 0)
+		r.Close()
+		if err != nil {
+			if list, isList := err.(scanner.ErrorList); isList {
+				for _, entry := range list {
+					errList = append(errList, entry)
+				}
+				continue
+			}
+			errList = append(errList, err)
+			continue
+		}
+		for _, decl := range file.Decls {
+			if d, ok := decl.(*ast.FuncDecl); ok && replacedDeclNames[funcName(d)] {
+				d.Name = ast.NewIdent("_")
+			}
+		}
+		files = append(files, applyPatches(file, fileSet, pkg.ImportPath))
+	}
+	if errList != nil {
+		return nil, errList
+	}
+	return files, nil
+}
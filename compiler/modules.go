@@ -0,0 +1,304 @@
+package compiler
+
+import (
+	"bufio"
+	"fmt"
+	"go/build"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// module holds the subset of a go.mod file's directives that are needed to
+// resolve an import path to a location on disk: the module's own path plus
+// its require, replace and exclude directives.
+type module struct {
+	path     string
+	requires []moduleReq
+	replaces map[string]moduleReq
+	excludes map[string]bool
+}
+
+type moduleReq struct {
+	path    string
+	version string
+}
+
+// findModuleRoot walks up from dir looking for a go.mod file, returning the
+// directory that contains it, or "" if dir is not inside a module.
+func findModuleRoot(dir string) string {
+	for {
+		if _, err := os.Stat(filepath.Join(dir, "go.mod")); err == nil {
+			return dir
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// parseGoMod does a minimal parse of a go.mod file: enough to resolve
+// import paths to module cache locations. It understands the module,
+// require, replace and exclude directives, in both single-line and
+// parenthesized block form.
+func parseGoMod(path string) (*module, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mod := &module{
+		replaces: make(map[string]moduleReq),
+		excludes: make(map[string]bool),
+	}
+
+	var block string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "//") {
+			continue
+		}
+		if block != "" {
+			if line == ")" {
+				block = ""
+				continue
+			}
+			applyGoModDirective(mod, block, line)
+			continue
+		}
+
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "module":
+			mod.path = strings.Trim(fields[1], `"`)
+		case "require", "replace", "exclude":
+			if len(fields) >= 2 && fields[1] == "(" {
+				block = fields[0]
+				continue
+			}
+			applyGoModDirective(mod, fields[0], strings.Join(fields[1:], " "))
+		}
+	}
+	return mod, scanner.Err()
+}
+
+func applyGoModDirective(mod *module, kind, rest string) {
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return
+	}
+	switch kind {
+	case "require":
+		if len(fields) < 2 {
+			return
+		}
+		mod.requires = append(mod.requires, moduleReq{path: fields[0], version: fields[1]})
+	case "exclude":
+		if len(fields) < 2 {
+			return
+		}
+		mod.excludes[fields[0]+"@"+fields[1]] = true
+	case "replace":
+		// "old [version] => new [version]"; keyed by old's path alone
+		i := -1
+		for j, f := range fields {
+			if f == "=>" {
+				i = j
+				break
+			}
+		}
+		if i == -1 || i+1 >= len(fields) {
+			return
+		}
+		r := moduleReq{path: fields[i+1]}
+		if i+2 < len(fields) {
+			r.version = fields[i+2]
+		}
+		mod.replaces[fields[0]] = r
+	}
+}
+
+// resolve finds the (possibly replaced) requirement that provides path,
+// following mod's replace directives over its own require graph.
+func (mod *module) resolve(path string) (moduleReq, bool) {
+	if r, ok := mod.replaces[path]; ok {
+		return r, true
+	}
+	for _, req := range mod.requires {
+		if req.path != path {
+			continue
+		}
+		if r, ok := mod.replaces[req.path+"@"+req.version]; ok {
+			return r, true
+		}
+		if mod.excludes[req.path+"@"+req.version] {
+			continue
+		}
+		return req, true
+	}
+	return moduleReq{}, false
+}
+
+// moduleCacheDir returns the location a module's source is expected to be
+// downloaded to under $GOPATH/pkg/mod, applying the module cache's
+// case-escaping rule for upper-case letters (X -> !x).
+func moduleCacheDir(gopath, path, version string) string {
+	return filepath.Join(gopath, "pkg", "mod", escapeModulePath(path)+"@"+version)
+}
+
+// moduleObjDir returns the per-module cache directory compiled .a files are
+// written to and read back from in module mode, mirroring the role
+// $GOPATH/pkg/<goos>_<goarch> plays in GOPATH mode.
+func moduleObjDir(gopath, archSuffix string) string {
+	return filepath.Join(gopath, "pkg", "mod", "cache", "gopherjs", archSuffix)
+}
+
+func escapeModulePath(path string) string {
+	var b strings.Builder
+	for _, r := range path {
+		if r >= 'A' && r <= 'Z' {
+			b.WriteByte('!')
+			b.WriteRune(r + ('a' - 'A'))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// nativesPrefix is the pseudo import-path namespace Parse uses to look up
+// GopherJS's own natives overlay (see compiler.go). It names a package
+// that is always part of the compiler's own source tree, never of the
+// module being compiled, so Import must resolve it via GOPATH/GOROOT even
+// when module-mode resolution is otherwise in effect.
+const nativesPrefix = "github.com/gopherjs/gopherjs/compiler/natives/"
+
+// Import resolves path the same way the package-level Import does, except
+// that in module mode it consults the module graph rooted at the go.mod
+// above the working directory rather than GOPATH, so that dependencies
+// fetched by "go mod download" into $GOPATH/pkg/mod resolve correctly,
+// including the replace/exclude directives of that go.mod; the go.mod
+// files of dependencies are not read. Standard-library packages (whose
+// first path element has no dot), "C", runtime, syscall and the natives
+// overlay still go through the package-level Import, so its
+// archSuffix-based .a lookup and runtime/syscall special cases keep
+// working unchanged. Packages of the main module and of its dependencies
+// are scanned directly by importModuleDir.
+func (t *Compiler) Import(path string, mode build.ImportMode, archSuffix string) (*build.Package, error) {
+	root := t.moduleRoot()
+	if root == "" || path == "C" || path == "runtime" || path == "syscall" || strings.HasPrefix(path, nativesPrefix) {
+		return Import(path, mode, archSuffix)
+	}
+
+	mod, err := parseGoMod(filepath.Join(root, "go.mod"))
+	if err != nil {
+		return nil, err
+	}
+	if path == mod.path || strings.HasPrefix(path, mod.path+"/") {
+		// Package belongs to the main module: it lives in the working tree
+		// at root, not necessarily under GOPATH/src, so it must be scanned
+		// directly rather than through the package-level, GOPATH-only
+		// Import.
+		sub := strings.TrimPrefix(strings.TrimPrefix(path, mod.path), "/")
+		return importModuleDir(filepath.Join(root, sub), path, mode, archSuffix)
+	}
+
+	if !strings.Contains(strings.SplitN(path, "/", 2)[0], ".") {
+		// Standard-library package: no module provides it.
+		return Import(path, mode, archSuffix)
+	}
+
+	// path may name a package inside a required module rather than the
+	// module itself, so try successively shorter prefixes of it.
+	modPath := path
+	req, ok := mod.resolve(modPath)
+	for !ok && strings.Contains(modPath, "/") {
+		modPath = modPath[:strings.LastIndex(modPath, "/")]
+		req, ok = mod.resolve(modPath)
+	}
+	if !ok {
+		return nil, fmt.Errorf("compiler: no required module provides package %q", path)
+	}
+	sub := strings.TrimPrefix(strings.TrimPrefix(path, modPath), "/")
+
+	if isFilesystemReplace(req.path) {
+		// A "replace old => ./local/dir" (or "../...") directive points
+		// straight at a directory on disk, with no version and nothing to
+		// look up in the module cache; resolve it relative to root, the
+		// same way a relative replace path is resolved relative to the
+		// replacing go.mod.
+		dir := req.path
+		if !filepath.IsAbs(dir) {
+			dir = filepath.Join(root, dir)
+		}
+		return importModuleDir(filepath.Join(dir, sub), path, mode, archSuffix)
+	}
+
+	gopath := firstGopathEntry(build.Default.GOPATH)
+	dir := moduleCacheDir(gopath, req.path, req.version)
+	return importModuleDir(filepath.Join(dir, sub), path, mode, archSuffix)
+}
+
+// isFilesystemReplace reports whether a replace directive's target is a
+// filesystem path rather than a module path: per the go.mod spec, that's
+// any target starting with "./" or "../", or an absolute path.
+func isFilesystemReplace(path string) bool {
+	return strings.HasPrefix(path, "./") || strings.HasPrefix(path, "../") || filepath.IsAbs(path)
+}
+
+// importModuleDir builds path's *build.Package by scanning dir directly,
+// the way every module-mode resolution path needs to (main-module packages
+// under root, dependencies under the module cache): go/build's ordinary
+// Import requires GOPATH/src layout, which module-resolved directories
+// don't follow. The result is tagged with path as its import path and with
+// an archSuffix-specific .a location under the module object cache, so a
+// later archSuffix build finds the right compiled output.
+func importModuleDir(dir, path string, mode build.ImportMode, archSuffix string) (*build.Package, error) {
+	buildContext := build.Default
+	buildContext.GOARCH = archSuffix
+	buildContext.Compiler = "gc"
+	buildContext.BuildTags = []string{"netgo"}
+	pkg, err := buildContext.ImportDir(dir, mode)
+	if err != nil {
+		return nil, err
+	}
+	pkg.ImportPath = path
+	pkg.PkgObj = filepath.Join(moduleObjDir(firstGopathEntry(build.Default.GOPATH), archSuffix), filepath.FromSlash(path)+".a")
+	return pkg, nil
+}
+
+// DisableModuleMode forces Import to use GOPATH resolution from now on,
+// even when a go.mod is found above the working directory. Unlike setting
+// ModuleMode back to false, this sticks: moduleRoot never auto-re-enables
+// module mode once it's been explicitly disabled.
+func (t *Compiler) DisableModuleMode() {
+	t.ModuleMode = false
+	t.moduleModeDisabled = true
+}
+
+// moduleRoot returns the directory containing the go.mod that governs the
+// working directory, auto-detecting module mode by looking for a go.mod
+// above cwd on every call. It never mutates t.ModuleMode - detection is
+// purely a local decision for this call - so a DisableModuleMode call
+// always sticks, forcing GOPATH resolution even when a go.mod is found.
+func (t *Compiler) moduleRoot() string {
+	if t.moduleModeDisabled {
+		return ""
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return ""
+	}
+	return findModuleRoot(wd)
+}
+
+func firstGopathEntry(gopath string) string {
+	if i := strings.IndexRune(gopath, filepath.ListSeparator); i != -1 {
+		return gopath[:i]
+	}
+	return gopath
+}
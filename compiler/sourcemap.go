@@ -0,0 +1,203 @@
+package compiler
+
+import (
+	"encoding/json"
+	"go/token"
+)
+
+// sourceMapSegment is one mapping from a generated (line, column) to an
+// original source position, as found between two '\b' markers written by
+// the compiler's code generator.
+type sourceMapSegment struct {
+	genColumn            int
+	sourceIndex          int
+	origLine, origColumn int
+	nameIndex            int
+	hasName              bool
+}
+
+// SourceMapBuilder accumulates the mappings SourceMapFilter's
+// MappingCallback reports and renders them as a standard Source Map v3
+// payload (https://sourcemaps.info/spec.html), so that browsers and Chrome
+// DevTools can map exceptions in the generated JS back to the original .go
+// files without a separate tool.
+type SourceMapBuilder struct {
+	File       string
+	SourceRoot string
+
+	sources        []string
+	sourceIndex    map[string]int
+	sourcesContent []string
+	names          []string
+	nameIndex      map[string]int
+	segmentsByLine map[int][]sourceMapSegment
+	maxLine        int
+}
+
+// NewSourceMapBuilder returns an empty SourceMapBuilder ready to have
+// mappings added via AddMapping.
+func NewSourceMapBuilder() *SourceMapBuilder {
+	return &SourceMapBuilder{
+		sourceIndex:    make(map[string]int),
+		nameIndex:      make(map[string]int),
+		segmentsByLine: make(map[int][]sourceMapSegment),
+	}
+}
+
+// AddMapping records that generatedLine/generatedColumn in the output
+// corresponds to originalPos in fileSet, optionally naming the symbol at
+// that position. It is meant to be called from a SourceMapFilter's
+// MappingCallback, which reports generatedLine 1-based (the first
+// generated line is 1); the Source Map v3 "mappings" string is 0-based
+// per generated line, so the line is converted here before being used as
+// the segmentsByLine key.
+func (b *SourceMapBuilder) AddMapping(generatedLine, generatedColumn int, fileSet *token.FileSet, originalPos token.Pos, name string) {
+	if !originalPos.IsValid() || fileSet == nil {
+		return
+	}
+	position := fileSet.Position(originalPos)
+	line := generatedLine - 1
+
+	seg := sourceMapSegment{
+		genColumn:   generatedColumn,
+		sourceIndex: b.sourceIdx(position.Filename),
+		origLine:    position.Line - 1,
+		origColumn:  position.Column - 1,
+	}
+	if name != "" {
+		seg.nameIndex = b.nameIdx(name)
+		seg.hasName = true
+	}
+
+	b.segmentsByLine[line] = append(b.segmentsByLine[line], seg)
+	if line > b.maxLine {
+		b.maxLine = line
+	}
+}
+
+// AddSourceContent embeds filename's contents in the map's sourcesContent
+// array, so consumers can show original source even without access to the
+// .go files on disk.
+func (b *SourceMapBuilder) AddSourceContent(filename, content string) {
+	b.sourceIdx(filename)
+	for len(b.sourcesContent) < len(b.sources) {
+		b.sourcesContent = append(b.sourcesContent, "")
+	}
+	b.sourcesContent[b.sourceIndex[filename]] = content
+}
+
+func (b *SourceMapBuilder) sourceIdx(filename string) int {
+	if i, ok := b.sourceIndex[filename]; ok {
+		return i
+	}
+	i := len(b.sources)
+	b.sources = append(b.sources, filename)
+	b.sourceIndex[filename] = i
+	return i
+}
+
+func (b *SourceMapBuilder) nameIdx(name string) int {
+	if i, ok := b.nameIndex[name]; ok {
+		return i
+	}
+	i := len(b.names)
+	b.names = append(b.names, name)
+	b.nameIndex[name] = i
+	return i
+}
+
+// sourceMapJSON is the on-the-wire Source Map v3 object.
+type sourceMapJSON struct {
+	Version        int      `json:"version"`
+	File           string   `json:"file,omitempty"`
+	SourceRoot     string   `json:"sourceRoot,omitempty"`
+	Sources        []string `json:"sources"`
+	SourcesContent []string `json:"sourcesContent,omitempty"`
+	Names          []string `json:"names"`
+	Mappings       string   `json:"mappings"`
+}
+
+// MarshalJSON renders b as a Source Map v3 JSON object.
+func (b *SourceMapBuilder) MarshalJSON() ([]byte, error) {
+	m := sourceMapJSON{
+		Version:    3,
+		File:       b.File,
+		SourceRoot: b.SourceRoot,
+		Sources:    b.sources,
+		Names:      b.names,
+		Mappings:   b.encodeMappings(),
+	}
+	if len(b.sourcesContent) != 0 {
+		m.SourcesContent = b.sourcesContent
+	}
+	if m.Sources == nil {
+		m.Sources = []string{}
+	}
+	if m.Names == nil {
+		m.Names = []string{}
+	}
+	return json.Marshal(m)
+}
+
+// encodeMappings renders the accumulated segments as the VLQ base64
+// "mappings" string: one comma-separated group of segments per generated
+// line, lines separated by ';'. Each segment encodes 1, 4 or 5 fields as
+// VLQ numbers, every field (except the line-relative generatedColumn) a
+// delta from the previous segment of the same kind across the whole map.
+func (b *SourceMapBuilder) encodeMappings() string {
+	var out []byte
+
+	prevSourceIndex, prevOrigLine, prevOrigColumn, prevNameIndex := 0, 0, 0, 0
+	for line := 0; line <= b.maxLine; line++ {
+		if line > 0 {
+			out = append(out, ';')
+		}
+		segs := b.segmentsByLine[line]
+		prevGenColumn := 0
+		for i, seg := range segs {
+			if i > 0 {
+				out = append(out, ',')
+			}
+			out = appendVLQ(out, seg.genColumn-prevGenColumn)
+			prevGenColumn = seg.genColumn
+
+			out = appendVLQ(out, seg.sourceIndex-prevSourceIndex)
+			prevSourceIndex = seg.sourceIndex
+			out = appendVLQ(out, seg.origLine-prevOrigLine)
+			prevOrigLine = seg.origLine
+			out = appendVLQ(out, seg.origColumn-prevOrigColumn)
+			prevOrigColumn = seg.origColumn
+
+			if seg.hasName {
+				out = appendVLQ(out, seg.nameIndex-prevNameIndex)
+				prevNameIndex = seg.nameIndex
+			}
+		}
+	}
+	return string(out)
+}
+
+const base64Chars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/"
+
+// appendVLQ appends the base64 VLQ encoding of value to out, following the
+// Source Map v3 convention: the sign is moved into the low bit, 5 bits of
+// magnitude per digit, and a continuation bit (0x20) set on every digit but
+// the last.
+func appendVLQ(out []byte, value int) []byte {
+	v := value << 1
+	if value < 0 {
+		v = (-value << 1) | 1
+	}
+	for {
+		digit := v & 0x1f
+		v >>= 5
+		if v > 0 {
+			digit |= 0x20
+		}
+		out = append(out, base64Chars[digit])
+		if v == 0 {
+			break
+		}
+	}
+	return out
+}
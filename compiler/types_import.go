@@ -0,0 +1,81 @@
+package compiler
+
+import (
+	"bytes"
+	"code.google.com/p/go.tools/go/gcimporter"
+	"code.google.com/p/go.tools/go/types"
+	"fmt"
+)
+
+// GcDataFormat tags the encoding used for an Archive's GcData, so that
+// LoadTypes knows which decoder to apply without guessing from the bytes
+// themselves.
+type GcDataFormat string
+
+const (
+	// GcDataFormatGc is gc's binary export format, as produced by the
+	// standard toolchain and decoded via gcimporter.ImportData. This is
+	// the format every archive used before GcDataFormat existed, so it's
+	// also what UnmarshalArchive assumes for archives that predate the
+	// tag.
+	GcDataFormatGc GcDataFormat = "gc"
+
+	// GcDataFormatNone marks a package with no exported type information
+	// at all, such as a command's main package, which nothing else ever
+	// imports.
+	GcDataFormatNone GcDataFormat = "none"
+)
+
+// TypesImporter decodes a package's exported type information from the raw
+// bytes recorded in an Archive's GcData, given the package's import path.
+// It plays the same role types.Importer plays for on-disk packages, except
+// keyed off of GcDataFormat rather than a fixed on-disk layout, so that
+// alternative backends - gccgo's .gox parser, go/internal/gcimporter's
+// newer indexed export format, or a pure-source type-checker for module
+// builds where no .a exists yet - can be slotted in by setting
+// Compiler.Importer.
+type TypesImporter interface {
+	Import(packages map[string]*types.Package, filename, path string, data []byte) (*types.Package, error)
+}
+
+// gcImporter is the TypesImporter LoadTypes always uses for GcDataFormatGc,
+// whatever Compiler.Importer holds: a thin adapter over
+// gcimporter.ImportData, preserving the behavior UnmarshalArchive used to
+// hard-code.
+type gcImporter struct{}
+
+func (gcImporter) Import(packages map[string]*types.Package, filename, path string, data []byte) (*types.Package, error) {
+	return gcimporter.ImportData(packages, filename, path, bytes.NewReader(data))
+}
+
+// LoadTypes decodes data (an Archive's GcData) as format and registers the
+// resulting package under path in t's type-checking universe. It is the
+// single entry point that replaces both the old hard-coded
+// gcimporter.ImportData call in UnmarshalArchive and NewEmptyTypesPackage:
+// GcDataFormatNone takes the place of the latter. GcDataFormatGc is always
+// decoded internally; every other format is handed to t.Importer, which
+// must be set, mirroring how TranslatePackage builds a
+// types.Config{Packages: t.typesPackages, Importer: ...} to type-check a
+// package from source.
+func (t *Compiler) LoadTypes(filename, path string, data []byte, format GcDataFormat) (*types.Package, error) {
+	if format == GcDataFormatNone {
+		pkg := types.NewPackage(path, path)
+		t.typesPackages[path] = pkg
+		return pkg, nil
+	}
+
+	var importer TypesImporter = gcImporter{}
+	if format != GcDataFormatGc {
+		if t.Importer == nil {
+			return nil, fmt.Errorf("compiler: no importer registered for gc data format %q", format)
+		}
+		importer = t.Importer
+	}
+
+	pkg, err := importer.Import(t.typesPackages, filename, path, data)
+	if err != nil {
+		return nil, err
+	}
+	t.typesPackages[pkg.Path()] = pkg
+	return pkg, nil
+}